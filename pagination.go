@@ -0,0 +1,214 @@
+package anaconda
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+//This file adds an iterator abstraction on top of the v1.1 endpoints that page
+//results via `cursor`/`next_cursor_str`, `max_id`, or `search_metadata.next_results`,
+//so callers no longer have to re-issue queries and thread cursor state by hand.
+
+//Cursor incrementally fetches pages of T from a paginated endpoint. Each call to
+//Next issues (at most) one query, through the same queryQueue/bucket every other
+//request goes through, so paginated fetches are rate limited exactly like any other.
+type Cursor[T any] struct {
+	fetchPage func(ctx context.Context) ([]T, bool, error)
+	hasMore   bool
+}
+
+//newCursor wraps fetchPage, which returns the next page of items, whether another
+//page may still be available, and any error encountered.
+func newCursor[T any](fetchPage func(ctx context.Context) ([]T, bool, error)) *Cursor[T] {
+	return &Cursor[T]{fetchPage: fetchPage, hasMore: true}
+}
+
+//HasMore reports whether a subsequent call to Next may return further results.
+//It starts out true and is only known to be false once a fetched page reports
+//no further cursor/token, or a prior call to Next returned an error.
+func (cur *Cursor[T]) HasMore() bool {
+	return cur.hasMore
+}
+
+//Next fetches the next page of results. Once HasMore returns false, Next is a
+//no-op that returns a nil page and a nil error.
+func (cur *Cursor[T]) Next(ctx context.Context) ([]T, error) {
+	if !cur.hasMore {
+		return nil, nil
+	}
+
+	items, hasMore, err := cur.fetchPage(ctx)
+	if err != nil {
+		cur.hasMore = false
+		return nil, err
+	}
+
+	cur.hasMore = hasMore
+	return items, nil
+}
+
+//streamAll drives cur to completion (or, if autoPaginate is disabled, for a single
+//page) in a goroutine, publishing each item to the returned channel as it arrives.
+//Both channels are closed once iteration ends; at most one error is ever sent. If ctx
+//is canceled the goroutine exits on its next send or fetch; a consumer that stops
+//reading without canceling ctx leaves the goroutine blocked on its next send.
+func streamAll[T any](ctx context.Context, c *TwitterApi, cur *Cursor[T]) (<-chan T, <-chan error) {
+	items := make(chan T)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(items)
+		defer close(errs)
+
+		for {
+			page, err := cur.Next(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for _, item := range page {
+				select {
+				case items <- item:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if !c.autoPaginate || !cur.HasMore() {
+				return
+			}
+		}
+	}()
+
+	return items, errs
+}
+
+//UserV1 is the subset of the classic v1.1 user object needed by the cursor-paginated
+//user list endpoints.
+type UserV1 struct {
+	IdStr      string `json:"id_str"`
+	ScreenName string `json:"screen_name"`
+	Name       string `json:"name"`
+}
+
+//TweetV1 is the subset of the classic v1.1 Tweet object needed by the id- and
+//token-paginated Tweet list endpoints.
+type TweetV1 struct {
+	IdStr string `json:"id_str"`
+	Text  string `json:"text"`
+}
+
+//followersListCursor builds the Cursor driving GET /1.1/followers/list.json, which
+//pages via the `cursor`/`next_cursor_str` parameters.
+func (c *TwitterApi) followersListCursor(v url.Values) *Cursor[UserV1] {
+	v = copyValues(v)
+	cursor := v.Get("cursor")
+	if cursor == "" {
+		cursor = "-1"
+	}
+
+	return newCursor(func(ctx context.Context) ([]UserV1, bool, error) {
+		page := copyValues(v)
+		page.Set("cursor", cursor)
+
+		var resp struct {
+			Users         []UserV1 `json:"users"`
+			NextCursorStr string   `json:"next_cursor_str"`
+		}
+		if err := c.oauthRequest(ctx, c.v1Host()+"/followers/list.json", page, &resp, _GET); err != nil {
+			return nil, false, err
+		}
+
+		cursor = resp.NextCursorStr
+		return resp.Users, cursor != "" && cursor != "0", nil
+	})
+}
+
+//GetFollowersListAll pages through GET /1.1/followers/list.json, following
+//`next_cursor_str` until Twitter reports no further results (or, with
+//WithAutoPaginate(false), after the first page), streaming each follower as it arrives.
+//Canceling ctx stops the walk; abandoning the returned channels alone does not.
+func (c *TwitterApi) GetFollowersListAll(ctx context.Context, v url.Values) (<-chan UserV1, <-chan error) {
+	return streamAll(ctx, c, c.followersListCursor(v))
+}
+
+//userTimelineCursor builds the Cursor driving GET /1.1/statuses/user_timeline.json,
+//which pages by walking `max_id` backwards from the oldest Tweet id seen so far.
+func (c *TwitterApi) userTimelineCursor(v url.Values) *Cursor[TweetV1] {
+	v = copyValues(v)
+	maxID := v.Get("max_id")
+
+	return newCursor(func(ctx context.Context) ([]TweetV1, bool, error) {
+		page := copyValues(v)
+		if maxID != "" {
+			page.Set("max_id", maxID)
+		}
+
+		var tweets []TweetV1
+		if err := c.oauthRequest(ctx, c.v1Host()+"/statuses/user_timeline.json", page, &tweets, _GET); err != nil {
+			return nil, false, err
+		}
+		if len(tweets) == 0 {
+			return tweets, false, nil
+		}
+
+		oldest, err := strconv.ParseInt(tweets[len(tweets)-1].IdStr, 10, 64)
+		if err != nil {
+			return tweets, false, nil
+		}
+		maxID = strconv.FormatInt(oldest-1, 10)
+		return tweets, true, nil
+	})
+}
+
+//GetUserTimelineAll pages through GET /1.1/statuses/user_timeline.json by walking
+//max_id backwards until Twitter returns an empty page (or, with
+//WithAutoPaginate(false), after the first page), streaming each Tweet as it arrives.
+//Canceling ctx stops the walk; abandoning the returned channels alone does not.
+func (c *TwitterApi) GetUserTimelineAll(ctx context.Context, v url.Values) (<-chan TweetV1, <-chan error) {
+	return streamAll(ctx, c, c.userTimelineCursor(v))
+}
+
+//searchCursor builds the Cursor driving GET /1.1/search/tweets.json, which pages via
+//the `next_results` query string Twitter embeds in each response's search_metadata.
+func (c *TwitterApi) searchCursor(query string, v url.Values) *Cursor[TweetV1] {
+	v = copyValues(v)
+	v.Set("q", query)
+	var next url.Values
+
+	return newCursor(func(ctx context.Context) ([]TweetV1, bool, error) {
+		page := v
+		if next != nil {
+			page = next
+		}
+
+		var resp struct {
+			Statuses       []TweetV1 `json:"statuses"`
+			SearchMetadata struct {
+				NextResults string `json:"next_results"`
+			} `json:"search_metadata"`
+		}
+		if err := c.oauthRequest(ctx, c.v1Host()+"/search/tweets.json", page, &resp, _GET); err != nil {
+			return nil, false, err
+		}
+		if resp.SearchMetadata.NextResults == "" {
+			return resp.Statuses, false, nil
+		}
+
+		parsed, err := url.ParseQuery(strings.TrimPrefix(resp.SearchMetadata.NextResults, "?"))
+		if err != nil {
+			return resp.Statuses, false, nil
+		}
+		next = parsed
+		return resp.Statuses, true, nil
+	})
+}
+
+//GetSearchAll pages through GET /1.1/search/tweets.json by following search_metadata's
+//next_results until Twitter stops returning it (or, with WithAutoPaginate(false), after
+//the first page), streaming each matching Tweet as it arrives.
+//Canceling ctx stops the walk; abandoning the returned channels alone does not.
+func (c *TwitterApi) GetSearchAll(ctx context.Context, query string, v url.Values) (<-chan TweetV1, <-chan error) {
+	return streamAll(ctx, c, c.searchCursor(query, v))
+}
@@ -0,0 +1,66 @@
+package anaconda
+
+import (
+	"container/list"
+	"sync"
+)
+
+//queryDeque is the internal queue backing TwitterApi.queryQueue. A plain channel can't
+//be re-prioritized, so rate-limited queries end up re-enqueued behind everything queued
+//after them; queryDeque instead supports pushing back to the front, which throttledQuery
+//uses to retry a rate-limited query ahead of (rather than behind) newer ones.
+type queryDeque struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	items  list.List
+	closed bool
+}
+
+func newQueryDeque() *queryDeque {
+	d := &queryDeque{}
+	d.cond = sync.NewCond(&d.mu)
+	return d
+}
+
+//PushBack enqueues q behind any query already queued.
+func (d *queryDeque) PushBack(q query) {
+	d.mu.Lock()
+	d.items.PushBack(q)
+	d.cond.Signal()
+	d.mu.Unlock()
+}
+
+//PushFront re-enqueues q ahead of any query already queued, preserving its place in line.
+func (d *queryDeque) PushFront(q query) {
+	d.mu.Lock()
+	d.items.PushFront(q)
+	d.cond.Signal()
+	d.mu.Unlock()
+}
+
+//PopFront blocks until a query is available and removes it, or returns ok=false once the
+//deque has been closed and drained.
+func (d *queryDeque) PopFront() (q query, ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for d.items.Len() == 0 {
+		if d.closed {
+			return query{}, false
+		}
+		d.cond.Wait()
+	}
+
+	front := d.items.Remove(d.items.Front())
+	return front.(query), true
+}
+
+//Close marks the deque closed; any PopFront call blocked on an empty deque returns
+//ok=false, as will any later call that finds the deque empty. Queries still queued
+//are returned by PopFront as usual.
+func (d *queryDeque) Close() {
+	d.mu.Lock()
+	d.closed = true
+	d.cond.Broadcast()
+	d.mu.Unlock()
+}
@@ -0,0 +1,101 @@
+package anaconda
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//This file turns the token bucket from a coarse, globally-configured throttle into an
+//accurate per-endpoint scheduler by tracking the X-Rate-Limit-* headers Twitter sends
+//on every response, and having throttledQuery consult them before firing a request that
+//would just come back rate-limited.
+
+const (
+	rateLimitLimitHeader     = "X-Rate-Limit-Limit"
+	rateLimitRemainingHeader = "X-Rate-Limit-Remaining"
+	rateLimitResetHeader     = "X-Rate-Limit-Reset"
+)
+
+//RateLimit is the most recently observed rate-limit state for one endpoint family, as
+//reported by Twitter's X-Rate-Limit-* response headers. See TwitterApi.RateLimitStatus.
+//Each recorded response replaces the previous state for its family, so Remaining is -1
+//whenever the latest recorded response did not report X-Rate-Limit-Remaining; only a
+//non-negative Remaining reflects an actual observed value.
+type RateLimit struct {
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+//RateLimitStatus returns the rate-limit state last observed for endpoint, and whether
+//any response carrying X-Rate-Limit-* headers has been seen for it yet; responses
+//without those headers are not recorded. endpoint is the same endpoint family key
+//recordRateLimit derives internally, e.g. "statuses/user_timeline" or "search/tweets" -
+//the request path with its API version prefix and ".json" suffix stripped.
+func (c *TwitterApi) RateLimitStatus(endpoint string) (RateLimit, bool) {
+	c.rateLimitMu.Lock()
+	defer c.rateLimitMu.Unlock()
+	rl, ok := c.rateLimits[endpoint]
+	return rl, ok
+}
+
+//recordRateLimit parses the X-Rate-Limit-* headers on a response, if present, and
+//stores them against urlStr's endpoint family for later consultation by throttledQuery
+//and RateLimitStatus.
+func (c *TwitterApi) recordRateLimit(urlStr string, header http.Header) {
+	limit, okLimit := parseRateLimitHeader(header.Get(rateLimitLimitHeader))
+	remaining, okRemaining := parseRateLimitHeader(header.Get(rateLimitRemainingHeader))
+	reset, okReset := parseRateLimitHeader(header.Get(rateLimitResetHeader))
+	if !okLimit && !okRemaining && !okReset {
+		return
+	}
+
+	rl := RateLimit{Limit: limit, Remaining: -1}
+	if okRemaining {
+		rl.Remaining = remaining
+	}
+	if okReset {
+		rl.Reset = time.Unix(int64(reset), 0)
+	}
+
+	family := rateLimitFamily(urlStr)
+
+	c.rateLimitMu.Lock()
+	if c.rateLimits == nil {
+		c.rateLimits = map[string]RateLimit{}
+	}
+	c.rateLimits[family] = rl
+	c.rateLimitMu.Unlock()
+}
+
+//parseRateLimitHeader parses a single X-Rate-Limit-* header value, reporting false if
+//it was absent or malformed.
+func parseRateLimitHeader(value string) (int, bool) {
+	if value == "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+//rateLimitFamily derives the endpoint family key used to group rate limits, by taking
+//urlStr's path and stripping its API version prefix ("/1.1/" or "/2/") and ".json"
+//suffix - e.g. "https://api.twitter.com/1.1/statuses/user_timeline.json?count=5" becomes
+//"statuses/user_timeline". This matches how Twitter documents and groups its rate limits.
+func rateLimitFamily(urlStr string) string {
+	path := urlStr
+	if u, err := url.Parse(urlStr); err == nil {
+		path = u.Path
+	}
+
+	path = strings.TrimSuffix(path, ".json")
+	path = strings.TrimPrefix(path, "/1.1/")
+	path = strings.TrimPrefix(path, "/2/")
+	return path
+}
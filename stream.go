@@ -0,0 +1,357 @@
+package anaconda
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//This file adds support for Twitter's streaming endpoints (stream.twitter.com and
+//userstream.twitter.com), which hold a single HTTP connection open and deliver
+//newline-delimited JSON messages for as long as the client stays connected. It
+//follows Twitter's documented reconnect guidance
+//(https://developer.twitter.com/en/docs/twitter-api/v1/tweets/filter-realtime/guides/connecting):
+//linear backoff on network errors, exponential backoff on HTTP errors, and an
+//immediate reconnect (with a stall warning) if no data arrives for 90 seconds.
+
+const (
+	filterStreamURL = "https://stream.twitter.com/1.1/statuses/filter.json"
+	sampleStreamURL = "https://stream.twitter.com/1.1/statuses/sample.json"
+	userStreamURL   = "https://userstream.twitter.com/1.1/user.json"
+
+	streamLinearBackoffStart = 250 * time.Millisecond
+	streamLinearBackoffStep  = 250 * time.Millisecond
+	streamLinearBackoffMax   = 16 * time.Second
+
+	streamExponentialBackoffStart = 5 * time.Second
+	streamExponentialBackoffMax   = 320 * time.Second
+
+	streamStallTimeout = 90 * time.Second
+)
+
+//StreamEvent is implemented by every message type a Stream can deliver on its C
+//channel: StreamTweet, StreamDelete, StreamLimit, StreamDisconnect, and StreamStallWarning.
+type StreamEvent interface {
+	streamEvent()
+}
+
+//StreamTweet is delivered for every Tweet matching the stream's filter predicate.
+type StreamTweet struct {
+	TweetV1
+}
+
+func (StreamTweet) streamEvent() {}
+
+//StreamDelete is delivered when a previously-delivered Tweet has been deleted.
+type StreamDelete struct {
+	IdStr     string
+	UserIdStr string
+}
+
+func (StreamDelete) streamEvent() {}
+
+//StreamLimit is delivered when messages have been dropped from the stream because
+//the client could not keep up; Track is the total number of undelivered messages.
+type StreamLimit struct {
+	Track int64
+}
+
+func (StreamLimit) streamEvent() {}
+
+//StreamDisconnect is delivered when Twitter cleanly closes the connection, e.g. because
+//a second client connected with the same credentials.
+type StreamDisconnect struct {
+	Code   int
+	Reason string
+}
+
+func (StreamDisconnect) streamEvent() {}
+
+//StreamStallWarning is delivered when the stream is falling behind Twitter's production
+//rate (Message/PercentFull, relayed verbatim from Twitter), or synthesized locally when
+//no data has arrived for streamStallTimeout and the connection is about to be recycled.
+type StreamStallWarning struct {
+	Message     string
+	PercentFull int
+}
+
+func (StreamStallWarning) streamEvent() {}
+
+//Stream represents a single logical connection to a Twitter streaming endpoint. It
+//transparently reconnects on network and HTTP errors and on stalls, for as long as
+//Stop has not been called.
+type Stream struct {
+	C <-chan StreamEvent
+
+	events chan StreamEvent
+	stopCh chan struct{}
+	client *http.Client
+}
+
+//Stop tears down the stream's connection (if any) and stops it from reconnecting.
+//It is safe to call more than once.
+func (s *Stream) Stop() {
+	select {
+	case <-s.stopCh:
+	default:
+		close(s.stopCh)
+	}
+}
+
+//PublicStreamFilter opens a filtered public stream (POST statuses/filter), matching
+//Tweets against track (keywords), follow (user ids), and locations (bounding boxes).
+//Any of the three may be nil/empty.
+func (c *TwitterApi) PublicStreamFilter(track []string, follow []string, locations []string) *Stream {
+	form := url.Values{}
+	if len(track) > 0 {
+		form.Set("track", strings.Join(track, ","))
+	}
+	if len(follow) > 0 {
+		form.Set("follow", strings.Join(follow, ","))
+	}
+	if len(locations) > 0 {
+		form.Set("locations", strings.Join(locations, ","))
+	}
+
+	return c.startStream(func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", filterStreamURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if err := c.signStreamRequest(req, form); err != nil {
+			return nil, err
+		}
+		return req, nil
+	})
+}
+
+//PublicStreamSample opens the public sample stream (GET statuses/sample), a small
+//random sample of all public Tweets.
+func (c *TwitterApi) PublicStreamSample() *Stream {
+	return c.startStream(func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", sampleStreamURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.signStreamRequest(req, nil); err != nil {
+			return nil, err
+		}
+		return req, nil
+	})
+}
+
+//UserStream opens the authenticated user's stream (GET user), delivering Tweets and
+//events relevant to that user (their own Tweets, mentions, home timeline, and so on).
+func (c *TwitterApi) UserStream() *Stream {
+	return c.startStream(func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", userStreamURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.signStreamRequest(req, nil); err != nil {
+			return nil, err
+		}
+		return req, nil
+	})
+}
+
+//signStreamRequest adds the Authorization header appropriate for c's auth mode, since
+//streaming requests bypass apiGet/apiPost and so need to sign themselves.
+func (c *TwitterApi) signStreamRequest(req *http.Request, form url.Values) error {
+	if c.appOnly {
+		req.Header.Set("Authorization", "Bearer "+c.bearerToken)
+		return nil
+	}
+	return oauthClient.SetAuthorizationHeader(req.Header, c.Credentials, req.Method, req.URL, cleanValues(form))
+}
+
+//startStream starts the goroutine that owns a Stream's connection for its whole
+//lifetime, reconnecting as needed until Stop is called.
+func (c *TwitterApi) startStream(buildRequest func() (*http.Request, error)) *Stream {
+	events := make(chan StreamEvent)
+	s := &Stream{
+		C:      events,
+		events: events,
+		stopCh: make(chan struct{}),
+		//A single, persistent, keep-alive-enabled client is reused across reconnects,
+		//as Twitter recommends for streaming clients.
+		client: &http.Client{},
+	}
+	go s.run(buildRequest)
+	return s
+}
+
+func (s *Stream) run(buildRequest func() (*http.Request, error)) {
+	defer close(s.events)
+
+	linearBackoff := streamLinearBackoffStart
+	exponentialBackoff := streamExponentialBackoffStart
+
+	for !s.stopped() {
+		req, err := buildRequest()
+		if err != nil {
+			return
+		}
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			// Network error: back off linearly.
+			if !s.sleep(linearBackoff) {
+				return
+			}
+			linearBackoff += streamLinearBackoffStep
+			if linearBackoff > streamLinearBackoffMax {
+				linearBackoff = streamLinearBackoffMax
+			}
+			continue
+		}
+
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			// HTTP error: back off exponentially.
+			if !s.sleep(exponentialBackoff) {
+				return
+			}
+			exponentialBackoff *= 2
+			if exponentialBackoff > streamExponentialBackoffMax {
+				exponentialBackoff = streamExponentialBackoffMax
+			}
+			continue
+		}
+
+		// Connected cleanly: reset both backoffs for the next time this happens.
+		linearBackoff = streamLinearBackoffStart
+		exponentialBackoff = streamExponentialBackoffStart
+
+		s.consume(resp)
+		// consume only returns once the connection ended (stopped, stalled, or the
+		// body was closed/errored); loop around and reconnect immediately.
+	}
+}
+
+//consume reads newline-delimited JSON messages from resp.Body, decoding and publishing
+//each to s.events, until the stream stalls, errors, ends, or Stop is called.
+func (s *Stream) consume(resp *http.Response) {
+	defer resp.Body.Close()
+
+	lines := make(chan []byte)
+	done := make(chan struct{})
+	go func() {
+		defer close(lines)
+		reader := bufio.NewReader(resp.Body)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if len(line) > 0 {
+				select {
+				case lines <- line:
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	defer close(done)
+
+	for {
+		select {
+		case <-s.stopCh:
+			return
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			event, err := parseStreamLine(line)
+			if err != nil || event == nil {
+				continue
+			}
+			select {
+			case s.events <- event:
+			case <-s.stopCh:
+				return
+			}
+		case <-time.After(streamStallTimeout):
+			select {
+			case s.events <- StreamStallWarning{Message: "no data received for 90s, reconnecting", PercentFull: 100}:
+			case <-s.stopCh:
+			}
+			return
+		}
+	}
+}
+
+//sleep waits for d, or until Stop is called, whichever comes first. It reports
+//whether the wait completed normally (false means the stream was stopped).
+func (s *Stream) sleep(d time.Duration) bool {
+	select {
+	case <-s.stopCh:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+func (s *Stream) stopped() bool {
+	select {
+	case <-s.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+//parseStreamLine decodes a single line of a streaming response into a StreamEvent.
+//Keep-alive newlines decode to (nil, nil) and should be ignored.
+func parseStreamLine(line []byte) (StreamEvent, error) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return nil, nil
+	}
+
+	var envelope struct {
+		Delete *struct {
+			Status struct {
+				IdStr     string `json:"id_str"`
+				UserIdStr string `json:"user_id_str"`
+			} `json:"status"`
+		} `json:"delete"`
+		Limit *struct {
+			Track int64 `json:"track"`
+		} `json:"limit"`
+		Disconnect *struct {
+			Code   int    `json:"code"`
+			Reason string `json:"reason"`
+		} `json:"disconnect"`
+		Warning *struct {
+			Message     string `json:"message"`
+			PercentFull int    `json:"percent_full"`
+		} `json:"warning"`
+	}
+	if err := json.Unmarshal(line, &envelope); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case envelope.Delete != nil:
+		return StreamDelete{IdStr: envelope.Delete.Status.IdStr, UserIdStr: envelope.Delete.Status.UserIdStr}, nil
+	case envelope.Limit != nil:
+		return StreamLimit{Track: envelope.Limit.Track}, nil
+	case envelope.Disconnect != nil:
+		return StreamDisconnect{Code: envelope.Disconnect.Code, Reason: envelope.Disconnect.Reason}, nil
+	case envelope.Warning != nil:
+		return StreamStallWarning{Message: envelope.Warning.Message, PercentFull: envelope.Warning.PercentFull}, nil
+	default:
+		var tweet TweetV1
+		if err := json.Unmarshal(line, &tweet); err != nil {
+			return nil, err
+		}
+		return StreamTweet{TweetV1: tweet}, nil
+	}
+}
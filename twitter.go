@@ -40,12 +40,16 @@
 package anaconda
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/ChimeraCoder/tokenbucket"
 	"github.com/garyburd/go-oauth/oauth"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -60,13 +64,41 @@ var oauthClient = oauth.Client{
 	TokenRequestURI:               "http://api.twitter.com/oauth/access_token",
 }
 
+const bearerTokenURL = "https://api.twitter.com/oauth2/token"
+const invalidateTokenURL = "https://api.twitter.com/oauth2/invalidate_token"
+const defaultAPIVersion = "1.1"
+
 type TwitterApi struct {
 	Credentials *oauth.Credentials
-	queryQueue  chan query
+	queryQueue  *queryDeque
 	bucket      *tokenbucket.Bucket
+
+	//APIVersion selects which version of api.twitter.com the classic (non-"V2") endpoint
+	//wrappers address, e.g. GetFollowersListAll and the rest of pagination.go; it defaults
+	//to "1.1" and is consulted by v1Host on every such request. It has no effect on the
+	//"V2" wrappers in v2.go, which always target the dedicated v2 API.
+	APIVersion string
+
+	//appOnly is true when this client was created with NewAppOnlyTwitterApi and
+	//should sign its requests with a bearer token instead of OAuth 1.0a
+	appOnly        bool
+	consumerKey    string
+	consumerSecret string
+	bearerToken    string
+
+	//autoPaginate controls whether the "All" endpoint wrappers (e.g. GetUserTimelineAll)
+	//keep following cursors/tokens until exhausted, or stop after a single page.
+	//See WithAutoPaginate.
+	autoPaginate bool
+
+	//rateLimits holds the most recently observed X-Rate-Limit-* headers, keyed by
+	//endpoint family (see rateLimitFamily). See RateLimitStatus.
+	rateLimitMu sync.Mutex
+	rateLimits  map[string]RateLimit
 }
 
 type query struct {
+	ctx         context.Context
 	url         string
 	form        url.Values
 	data        interface{}
@@ -85,14 +117,101 @@ const DEFAULT_CAPACITY = 5
 //NewTwitterApi takes an user-specific access token and secret and returns a TwitterApi struct for that user.
 //The TwitterApi struct can be used for accessing any of the endpoints available.
 func NewTwitterApi(access_token string, access_token_secret string) *TwitterApi {
-	//TODO figure out how much to buffer this channel
-	//A non-buffered channel will cause blocking when multiple queries are made at the same time
-	queue := make(chan query)
-	c := &TwitterApi{&oauth.Credentials{Token: access_token, Secret: access_token_secret}, queue, nil}
+	queue := newQueryDeque()
+	c := &TwitterApi{Credentials: &oauth.Credentials{Token: access_token, Secret: access_token_secret}, queryQueue: queue, APIVersion: "1.1", autoPaginate: true}
 	go c.throttledQuery()
 	return c
 }
 
+//NewAppOnlyTwitterApi takes an application's consumer key and secret and exchanges them
+//for an OAuth2 bearer token, returning a TwitterApi struct that authenticates its
+//requests with that bearer token rather than OAuth 1.0a user credentials.
+//This application-only auth flow does not require a user access token, and Twitter
+//applies its (generally higher) app-only rate limits to requests made with it.
+func NewAppOnlyTwitterApi(consumer_key string, consumer_secret string) (*TwitterApi, error) {
+	bearerToken, err := fetchBearerToken(consumer_key, consumer_secret)
+	if err != nil {
+		return nil, err
+	}
+
+	queue := newQueryDeque()
+	c := &TwitterApi{
+		queryQueue:     queue,
+		APIVersion:     "1.1",
+		appOnly:        true,
+		consumerKey:    consumer_key,
+		consumerSecret: consumer_secret,
+		bearerToken:    bearerToken,
+		autoPaginate:   true,
+	}
+	go c.throttledQuery()
+	return c, nil
+}
+
+//fetchBearerToken exchanges a consumer key/secret pair for a bearer token, as described in
+//https://dev.twitter.com/oauth/application-only
+func fetchBearerToken(consumer_key string, consumer_secret string) (string, error) {
+	req, err := http.NewRequest("POST", bearerTokenURL, strings.NewReader("grant_type=client_credentials"))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Basic "+basicCredentials(consumer_key, consumer_secret))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded;charset=UTF-8")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", newApiError(resp)
+	}
+
+	var tokenResp struct {
+		TokenType   string `json:"token_type"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", err
+	}
+	return tokenResp.AccessToken, nil
+}
+
+//basicCredentials builds the base64-encoded "key:secret" value used for the
+//Authorization: Basic header of the bearer token endpoints.
+func basicCredentials(consumer_key string, consumer_secret string) string {
+	return base64.StdEncoding.EncodeToString([]byte(url.QueryEscape(consumer_key) + ":" + url.QueryEscape(consumer_secret)))
+}
+
+//InvalidateBearerToken invalidates the current bearer token, after which the TwitterApi
+//struct can no longer be used to make requests unless a new token is obtained.
+//It is only valid to call this on a TwitterApi created with NewAppOnlyTwitterApi.
+func (c *TwitterApi) InvalidateBearerToken() error {
+	form := url.Values{}
+	form.Set("access_token", c.bearerToken)
+
+	req, err := http.NewRequest("POST", invalidateTokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Basic "+basicCredentials(c.consumerKey, c.consumerSecret))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded;charset=UTF-8")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return newApiError(resp)
+	}
+
+	c.bearerToken = ""
+	return nil
+}
+
 //SetConsumerKey will set the application-specific consumer_key used in the initial OAuth process
 //This key is listed on https://dev.twitter.com/apps/YOUR_APP_ID/show
 func SetConsumerKey(consumer_key string) {
@@ -115,6 +234,25 @@ func (c *TwitterApi) DisableRateLimiting() {
 	c.bucket = nil
 }
 
+// WithAutoPaginate controls whether the "All" endpoint wrappers (e.g. GetUserTimelineAll,
+// GetSearchAll) keep following cursors/tokens until the endpoint is exhausted (the default)
+// or stop after returning a single page. It returns c so it can be chained onto NewTwitterApi.
+func (c *TwitterApi) WithAutoPaginate(autoPaginate bool) *TwitterApi {
+	c.autoPaginate = autoPaginate
+	return c
+}
+
+// v1Host returns the api.twitter.com base URL for c.APIVersion, defaulting to "1.1" when
+// it is unset. Every classic (non-"V2") endpoint wrapper builds its request URL from this
+// rather than hardcoding "/1.1/", so setting APIVersion actually changes where they go.
+func (c *TwitterApi) v1Host() string {
+	version := c.APIVersion
+	if version == "" {
+		version = defaultAPIVersion
+	}
+	return "https://api.twitter.com/" + version
+}
+
 // SetDelay will set the delay between throttled queries
 // To turn of throttling, set it to 0 seconds
 func (c *TwitterApi) SetDelay(t time.Duration) {
@@ -143,28 +281,84 @@ func cleanValues(v url.Values) url.Values {
 	return v
 }
 
+//copyValues returns a shallow copy of v, so that callers can mutate individual
+//parameters (e.g. cursor, max_id) between paginated requests without mutating
+//the url.Values the caller originally passed in.
+func copyValues(v url.Values) url.Values {
+	copied := url.Values{}
+	for key, values := range v {
+		copied[key] = values
+	}
+	return copied
+}
+
 // apiGet issues a GET request to the Twitter API and decodes the response JSON to data.
-func (c TwitterApi) apiGet(urlStr string, form url.Values, data interface{}) error {
-	resp, err := oauthClient.Get(http.DefaultClient, c.Credentials, urlStr, form)
+// ctx is propagated onto the underlying http.Request, so canceling it aborts the request
+// in flight rather than merely discarding the response.
+func (c *TwitterApi) apiGet(ctx context.Context, urlStr string, form url.Values, data interface{}) error {
+	resp, err := c.do(ctx, "GET", urlStr, form)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
-	return decodeResponse(resp, data)
+	return c.decodeResponse(resp, data)
 }
 
 // apiPost issues a POST request to the Twitter API and decodes the response JSON to data.
-func (c TwitterApi) apiPost(urlStr string, form url.Values, data interface{}) error {
-	resp, err := oauthClient.Post(http.DefaultClient, c.Credentials, urlStr, form)
+// ctx is propagated onto the underlying http.Request, so canceling it aborts the request
+// in flight rather than merely discarding the response.
+func (c *TwitterApi) apiPost(ctx context.Context, urlStr string, form url.Values, data interface{}) error {
+	resp, err := c.do(ctx, "POST", urlStr, form)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
-	return decodeResponse(resp, data)
+	return c.decodeResponse(resp, data)
+}
+
+// do builds and issues a single signed HTTP request: OAuth 1.0a for ordinary clients,
+// or "Authorization: Bearer <token>" for clients created with NewAppOnlyTwitterApi.
+// Signing happens against the bare URL and form, before form is appended as a GET query
+// string, matching how the oauth package itself signs Get/Post requests.
+func (c *TwitterApi) do(ctx context.Context, method string, urlStr string, form url.Values) (*http.Response, error) {
+	form = cleanValues(form)
+
+	var req *http.Request
+	var err error
+	switch method {
+	case "GET":
+		req, err = http.NewRequest("GET", urlStr, nil)
+	case "POST":
+		req, err = http.NewRequest("POST", urlStr, strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	default:
+		return nil, fmt.Errorf("HTTP method not yet supported")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if c.appOnly {
+		req.Header.Set("Authorization", "Bearer "+c.bearerToken)
+	} else if err := oauthClient.SetAuthorizationHeader(req.Header, c.Credentials, req.Method, req.URL, form); err != nil {
+		return nil, err
+	}
+
+	if method == "GET" && len(form) > 0 {
+		req.URL.RawQuery = form.Encode()
+	}
+
+	return http.DefaultClient.Do(req.WithContext(ctx))
 }
 
-// decodeResponse decodes the JSON response from the Twitter API.
-func decodeResponse(resp *http.Response, data interface{}) error {
+// decodeResponse records the response's rate-limit headers (see rateLimitFamily) and
+// decodes the JSON response from the Twitter API.
+func (c *TwitterApi) decodeResponse(resp *http.Response, data interface{}) error {
+	if resp.Request != nil {
+		c.recordRateLimit(resp.Request.URL.String(), resp.Header)
+	}
 	if resp.StatusCode != 200 {
 		return newApiError(resp)
 	}
@@ -173,53 +367,98 @@ func decodeResponse(resp *http.Response, data interface{}) error {
 
 //query executes a query to the specified url, sending the values specified by form, and decodes the response JSON to data
 //method can be either _GET or _POST
-func (c TwitterApi) execQuery(urlStr string, form url.Values, data interface{}, method int) error {
+func (c *TwitterApi) execQuery(ctx context.Context, urlStr string, form url.Values, data interface{}, method int) error {
 	switch method {
 	case _GET:
-		return c.apiGet(urlStr, form, data)
+		return c.apiGet(ctx, urlStr, form, data)
 	case _POST:
-		return c.apiPost(urlStr, form, data)
+		return c.apiPost(ctx, urlStr, form, data)
 	default:
 		return fmt.Errorf("HTTP method not yet supported")
 	}
 }
 
+//oauthRequest enqueues a query on the queryQueue and blocks until throttledQuery has
+//run it through execQuery and decoded the response into data. Endpoint wrapper functions
+//use this instead of calling execQuery directly so that every request is subject to the
+//same rate limiting and retry logic. If ctx is canceled before the query is dequeued, it
+//is dropped without ever being sent, and ctx.Err() is returned; if it is canceled while
+//the request is in flight, the underlying HTTP request is aborted.
+func (c *TwitterApi) oauthRequest(ctx context.Context, urlStr string, form url.Values, data interface{}, method int) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	response_ch := make(chan response, 1)
+	c.queryQueue.PushBack(query{ctx, urlStr, form, data, method, response_ch})
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case resp := <-response_ch:
+		return resp.err
+	}
+}
+
 // throttledQuery executes queries and automatically throttles them according to SECONDS_PER_QUERY
 // It is the only function that reads from the queryQueue for a particular *TwitterApi struct
-
 func (c *TwitterApi) throttledQuery() {
-	for q := range c.queryQueue {
-		url := q.url
-		form := q.form
-		data := q.data //This is where the actual response will be written
-		method := q.method
+	for {
+		q, ok := c.queryQueue.PopFront()
+		if !ok {
+			return
+		}
 
-		response_ch := q.response_ch
+		// If the caller's context was already canceled while this query was sitting in
+		// the queue, drop it without ever dispatching it.
+		if err := q.ctx.Err(); err != nil {
+			q.response_ch <- response{q.data, err}
+			continue
+		}
+
+		// If the last response we saw for this endpoint's family reported no requests
+		// remaining, wait out the window Twitter told us about rather than firing a
+		// request we already know will come back rate-limited.
+		if rl, ok := c.RateLimitStatus(rateLimitFamily(q.url)); ok && rl.Remaining == 0 && !rl.Reset.IsZero() {
+			if wait := time.Until(rl.Reset); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-q.ctx.Done():
+					q.response_ch <- response{q.data, q.ctx.Err()}
+					continue
+				}
+			}
+		}
 
 		if c.bucket != nil {
 			<-c.bucket.SpendToken(1)
 		}
 
-		err := c.execQuery(url, form, data, method)
+		err := c.execQuery(q.ctx, q.url, q.form, q.data, q.method)
 
 		// Check if Twitter returned a rate-limiting error
 		if err != nil {
 			if apiErr, ok := err.(*ApiError); ok {
 				if isRateLimitError, nextWindow := apiErr.RateLimitCheck(); isRateLimitError {
-					// If this is a rate-limiting error, re-add the job to the queue
-					// TODO it really should preserve order
-					c.QueryQueue <- q
-					<-time.After(nextWindow.Sub(time.Now()))
+					// Re-add the job to the front of the queue, so it retries ahead of
+					// (rather than behind) anything enqueued after it.
+					c.queryQueue.PushFront(q)
+					select {
+					case <-time.After(nextWindow.Sub(time.Now())):
+					case <-q.ctx.Done():
+					}
 					// Drain the bucket (start over fresh)
-					c.bucket.Drain()
+					if c.bucket != nil {
+						c.bucket.Drain()
+					}
+					continue
 				}
 			}
-		} else {
-
-			response_ch <- struct {
-				data interface{}
-				err  error
-			}{data, err}
 		}
+
+		q.response_ch <- response{q.data, err}
 	}
 }
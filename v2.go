@@ -0,0 +1,161 @@
+package anaconda
+
+import (
+	"context"
+	"net/url"
+	"strings"
+)
+
+//This file adds initial support for version 2 of the Twitter API
+//(https://developer.twitter.com/en/docs/twitter-api), alongside the v1.1
+//endpoints implemented elsewhere in the package. V2 endpoints are recognizable
+//by their "V2" suffix and their api.twitter.com/2/... URLs; unlike the v1.1
+//endpoints, they decode into the data/includes/meta envelope Twitter uses
+//throughout the v2 API.
+
+const apiV2Host = "https://api.twitter.com/2"
+
+//UserV2 represents a Twitter user as returned by the v2 API.
+type UserV2 struct {
+	Id            string `json:"id"`
+	Name          string `json:"name"`
+	Username      string `json:"username"`
+	PinnedTweetId string `json:"pinned_tweet_id,omitempty"`
+}
+
+//TweetV2 represents a Tweet as returned by the v2 API.
+type TweetV2 struct {
+	Id       string `json:"id"`
+	Text     string `json:"text"`
+	AuthorId string `json:"author_id,omitempty"`
+}
+
+//MetaV2 carries the pagination and result-count information Twitter includes
+//on v2 list endpoints.
+type MetaV2 struct {
+	ResultCount   int    `json:"result_count,omitempty"`
+	NextToken     string `json:"next_token,omitempty"`
+	PreviousToken string `json:"previous_token,omitempty"`
+}
+
+//UsersV2Includes holds the objects returned via `expansions` alongside a users response,
+//e.g. the tweets referenced by each user's pinned_tweet_id.
+type UsersV2Includes struct {
+	Tweets []TweetV2 `json:"tweets,omitempty"`
+}
+
+//TweetsV2Includes holds the objects returned via `expansions` alongside a tweets response,
+//e.g. the users referenced by each tweet's author_id.
+type TweetsV2Includes struct {
+	Users []UserV2 `json:"users,omitempty"`
+}
+
+//UserV2Response is the envelope returned by v2 endpoints addressing a single user.
+type UserV2Response struct {
+	Data     UserV2          `json:"data"`
+	Includes UsersV2Includes `json:"includes,omitempty"`
+}
+
+//UsersV2Response is the envelope returned by v2 endpoints addressing multiple users.
+type UsersV2Response struct {
+	Data     []UserV2        `json:"data"`
+	Includes UsersV2Includes `json:"includes,omitempty"`
+	Meta     MetaV2          `json:"meta,omitempty"`
+}
+
+//TweetsV2Response is the envelope returned by v2 endpoints addressing multiple Tweets.
+type TweetsV2Response struct {
+	Data     []TweetV2        `json:"data"`
+	Includes TweetsV2Includes `json:"includes,omitempty"`
+	Meta     MetaV2           `json:"meta,omitempty"`
+}
+
+//GetUsersV2 returns the users identified by ids. v may contain the `expansions`,
+//`tweet.fields`, and `user.fields` query parameters supported by
+//GET /2/users (https://developer.twitter.com/en/docs/twitter-api/users/lookup/api-reference/get-users).
+func (c *TwitterApi) GetUsersV2(ids []string, v url.Values) (UsersV2Response, error) {
+	return c.GetUsersV2WithContext(context.Background(), ids, v)
+}
+
+//GetUsersV2WithContext is GetUsersV2 with a caller-supplied context.
+func (c *TwitterApi) GetUsersV2WithContext(ctx context.Context, ids []string, v url.Values) (UsersV2Response, error) {
+	v = cleanValues(v)
+	v.Set("ids", strings.Join(ids, ","))
+
+	var response UsersV2Response
+	err := c.oauthRequest(ctx, apiV2Host+"/users", v, &response, _GET)
+	return response, err
+}
+
+//GetUserByIDV2 returns the user identified by id. v may contain the `expansions`,
+//`tweet.fields`, and `user.fields` query parameters supported by
+//GET /2/users/:id (https://developer.twitter.com/en/docs/twitter-api/users/lookup/api-reference/get-users-id).
+func (c *TwitterApi) GetUserByIDV2(id string, v url.Values) (UserV2Response, error) {
+	return c.GetUserByIDV2WithContext(context.Background(), id, v)
+}
+
+//GetUserByIDV2WithContext is GetUserByIDV2 with a caller-supplied context.
+func (c *TwitterApi) GetUserByIDV2WithContext(ctx context.Context, id string, v url.Values) (UserV2Response, error) {
+	var response UserV2Response
+	err := c.oauthRequest(ctx, apiV2Host+"/users/"+id, cleanValues(v), &response, _GET)
+	return response, err
+}
+
+//GetUsersByUsernameV2 returns the users identified by usernames. v may contain the
+//`expansions`, `tweet.fields`, and `user.fields` query parameters supported by
+//GET /2/users/by (https://developer.twitter.com/en/docs/twitter-api/users/lookup/api-reference/get-users-by).
+func (c *TwitterApi) GetUsersByUsernameV2(usernames []string, v url.Values) (UsersV2Response, error) {
+	return c.GetUsersByUsernameV2WithContext(context.Background(), usernames, v)
+}
+
+//GetUsersByUsernameV2WithContext is GetUsersByUsernameV2 with a caller-supplied context.
+func (c *TwitterApi) GetUsersByUsernameV2WithContext(ctx context.Context, usernames []string, v url.Values) (UsersV2Response, error) {
+	v = cleanValues(v)
+	v.Set("usernames", strings.Join(usernames, ","))
+
+	var response UsersV2Response
+	err := c.oauthRequest(ctx, apiV2Host+"/users/by", v, &response, _GET)
+	return response, err
+}
+
+//GetUserTweetsV2 returns the most recent Tweets authored by the user identified by id.
+//v may contain the `expansions`, `tweet.fields`, and `user.fields` query parameters
+//supported by GET /2/users/:id/tweets.
+func (c *TwitterApi) GetUserTweetsV2(id string, v url.Values) (TweetsV2Response, error) {
+	return c.GetUserTweetsV2WithContext(context.Background(), id, v)
+}
+
+//GetUserTweetsV2WithContext is GetUserTweetsV2 with a caller-supplied context.
+func (c *TwitterApi) GetUserTweetsV2WithContext(ctx context.Context, id string, v url.Values) (TweetsV2Response, error) {
+	var response TweetsV2Response
+	err := c.oauthRequest(ctx, apiV2Host+"/users/"+id+"/tweets", cleanValues(v), &response, _GET)
+	return response, err
+}
+
+//GetUserFollowersV2 returns the users following the user identified by id. v may contain
+//the `expansions`, `tweet.fields`, and `user.fields` query parameters supported by
+//GET /2/users/:id/followers.
+func (c *TwitterApi) GetUserFollowersV2(id string, v url.Values) (UsersV2Response, error) {
+	return c.GetUserFollowersV2WithContext(context.Background(), id, v)
+}
+
+//GetUserFollowersV2WithContext is GetUserFollowersV2 with a caller-supplied context.
+func (c *TwitterApi) GetUserFollowersV2WithContext(ctx context.Context, id string, v url.Values) (UsersV2Response, error) {
+	var response UsersV2Response
+	err := c.oauthRequest(ctx, apiV2Host+"/users/"+id+"/followers", cleanValues(v), &response, _GET)
+	return response, err
+}
+
+//GetUserFollowingV2 returns the users followed by the user identified by id. v may contain
+//the `expansions`, `tweet.fields`, and `user.fields` query parameters supported by
+//GET /2/users/:id/following.
+func (c *TwitterApi) GetUserFollowingV2(id string, v url.Values) (UsersV2Response, error) {
+	return c.GetUserFollowingV2WithContext(context.Background(), id, v)
+}
+
+//GetUserFollowingV2WithContext is GetUserFollowingV2 with a caller-supplied context.
+func (c *TwitterApi) GetUserFollowingV2WithContext(ctx context.Context, id string, v url.Values) (UsersV2Response, error) {
+	var response UsersV2Response
+	err := c.oauthRequest(ctx, apiV2Host+"/users/"+id+"/following", cleanValues(v), &response, _GET)
+	return response, err
+}